@@ -0,0 +1,41 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+package main
+
+import "errors"
+
+// Event describes a single value change observed on a watched prefix.
+type Event struct {
+	Key   string
+	Value string
+}
+
+// Backend abstracts the datastore that template values and watch
+// notifications come from, so ProcessConfig never has to know whether it is
+// talking to etcd, Consul, Redis or Vault.
+type Backend interface {
+	// Get returns the flattened key/value pairs found under prefix/key.
+	Get(prefix, key string) (map[string]string, error)
+	// Watch returns at once with a channel on which the individual changes
+	// under prefix are streamed; the channel is closed once stop is closed
+	// or the watch disconnects.
+	Watch(prefix string, stop <-chan struct{}) (<-chan Event, error)
+}
+
+// NewBackend builds the Backend named by settings.Backend, defaulting to
+// etcd for backward compatibility with existing confd.ini files.
+func NewBackend(settings Settings) (Backend, error) {
+	switch settings.Backend {
+	case "", "etcd", "etcdv3":
+		return NewEtcdv3Backend(settings)
+	case "consul":
+		return NewConsulBackend(settings)
+	case "redis":
+		return NewRedisBackend(settings)
+	case "vault":
+		return NewVaultBackend(settings)
+	default:
+		return nil, errors.New("unknown backend: " + settings.Backend)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// ConsulBackend talks to Consul's KV store.
+type ConsulBackend struct {
+	client *consul.Client
+}
+
+// NewConsulBackend dials the Consul agent at settings.ConsulURL.
+func NewConsulBackend(settings Settings) (Backend, error) {
+	cfg := consul.DefaultConfig()
+	if settings.ConsulURL != "" {
+		cfg.Address = settings.ConsulURL
+	}
+	client, err := consul.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsulBackend{client: client}, nil
+}
+
+func (b *ConsulBackend) Get(prefix, key string) (map[string]string, error) {
+	pairs, _, err := b.client.KV().List(filepath.Join(prefix, key), nil)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		values[pair.Key] = string(pair.Value)
+	}
+	return values, nil
+}
+
+func (b *ConsulBackend) Watch(prefix string, stop <-chan struct{}) (<-chan Event, error) {
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		var lastIndex uint64
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			pairs, meta, err := b.client.KV().List(prefix, &consul.QueryOptions{
+				WaitIndex: lastIndex,
+				WaitTime:  time.Minute,
+			})
+			if err != nil {
+				log.Error("consul watch on " + prefix + ": " + err.Error())
+				time.Sleep(time.Second)
+				continue
+			}
+			lastIndex = meta.LastIndex
+			for _, pair := range pairs {
+				events <- Event{Key: pair.Key, Value: string(pair.Value)}
+			}
+		}
+	}()
+	return events, nil
+}
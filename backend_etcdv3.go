@@ -0,0 +1,66 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+
+	clientv3 "github.com/coreos/etcd/clientv3"
+)
+
+// Etcdv3Backend talks to an etcd v3 cluster.
+type Etcdv3Backend struct {
+	client *clientv3.Client
+}
+
+// NewEtcdv3Backend dials the etcd cluster at settings.EtcdURL.
+func NewEtcdv3Backend(settings Settings) (Backend, error) {
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(settings.EtcdURL, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Etcdv3Backend{client: c}, nil
+}
+
+func (b *Etcdv3Backend) Get(prefix, key string) (map[string]string, error) {
+	resp, err := b.client.Get(context.Background(), filepath.Join(prefix, key), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		values[string(kv.Key)] = string(kv.Value)
+	}
+	return values, nil
+}
+
+func (b *Etcdv3Backend) Watch(prefix string, stop <-chan struct{}) (<-chan Event, error) {
+	events := make(chan Event)
+	ctx, cancel := context.WithCancel(context.Background())
+	watchChan := b.client.Watch(ctx, prefix, clientv3.WithPrefix())
+	go func() {
+		defer close(events)
+		defer cancel()
+		for {
+			select {
+			case <-stop:
+				return
+			case resp, ok := <-watchChan:
+				if !ok {
+					return
+				}
+				for _, ev := range resp.Events {
+					events <- Event{Key: string(ev.Kv.Key), Value: string(ev.Kv.Value)}
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+// RedisBackend talks to a Redis server, using a flat key namespace.
+type RedisBackend struct {
+	client *redis.Client
+}
+
+// NewRedisBackend dials the Redis server at settings.RedisURL.
+func NewRedisBackend(settings Settings) (Backend, error) {
+	client := redis.NewClient(&redis.Options{Addr: settings.RedisURL})
+	return &RedisBackend{client: client}, nil
+}
+
+func (b *RedisBackend) Get(prefix, key string) (map[string]string, error) {
+	ctx := context.Background()
+	pattern := filepath.Join(prefix, key) + "*"
+	keys, err := b.client.Keys(ctx, pattern).Result()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(keys))
+	for _, k := range keys {
+		v, err := b.client.Get(ctx, k).Result()
+		if err != nil {
+			return nil, err
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+func (b *RedisBackend) Watch(prefix string, stop <-chan struct{}) (<-chan Event, error) {
+	events := make(chan Event)
+	ctx := context.Background()
+	sub := b.client.PSubscribe(ctx, "__keyspace@0__:"+prefix+"*")
+	go func() {
+		defer close(events)
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-stop:
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				key := msg.Channel[len("__keyspace@0__:"):]
+				v, err := b.client.Get(ctx, key).Result()
+				if err != nil {
+					continue
+				}
+				events <- Event{Key: key, Value: v}
+			}
+		}
+	}()
+	return events, nil
+}
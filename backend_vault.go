@@ -0,0 +1,126 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// VaultBackend reads secrets out of Vault's KV v2 secrets engine and renews
+// the lease on any dynamic secret it hands out.
+type VaultBackend struct {
+	client *vault.Client
+
+	renewingMu sync.Mutex
+	renewing   map[string]bool
+}
+
+// NewVaultBackend dials the Vault server at settings.VaultURL using
+// settings.VaultToken.
+func NewVaultBackend(settings Settings) (Backend, error) {
+	cfg := vault.DefaultConfig()
+	if settings.VaultURL != "" {
+		cfg.Address = settings.VaultURL
+	}
+	client, err := vault.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if settings.VaultToken != "" {
+		client.SetToken(settings.VaultToken)
+	}
+	return &VaultBackend{client: client, renewing: make(map[string]bool)}, nil
+}
+
+func (b *VaultBackend) Get(prefix, key string) (map[string]string, error) {
+	path := filepath.Join("secret/data", prefix, key)
+	secret, err := b.client.Logical().Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return map[string]string{}, nil
+	}
+	if secret.LeaseDuration > 0 {
+		b.renewOnce(path, secret)
+	}
+	data, _ := secret.Data["data"].(map[string]interface{})
+	values := make(map[string]string, len(data))
+	for k, v := range data {
+		values[filepath.Join(prefix, key, k)] = fmt.Sprintf("%v", v)
+	}
+	return values, nil
+}
+
+// renewOnce starts a renewer for path's lease unless one is already
+// running. Get is called on every interval tick and every watch-triggered
+// re-render, so without this a renewer would leak on every call.
+func (b *VaultBackend) renewOnce(path string, secret *vault.Secret) {
+	b.renewingMu.Lock()
+	if b.renewing[path] {
+		b.renewingMu.Unlock()
+		return
+	}
+	b.renewing[path] = true
+	b.renewingMu.Unlock()
+
+	go func() {
+		defer func() {
+			b.renewingMu.Lock()
+			delete(b.renewing, path)
+			b.renewingMu.Unlock()
+		}()
+		b.renew(secret)
+	}()
+}
+
+// renew keeps a dynamic secret's lease alive for as long as confd is using
+// it, rather than letting Vault revoke it out from under a rendered file.
+func (b *VaultBackend) renew(secret *vault.Secret) {
+	watcher, err := b.client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{Secret: secret})
+	if err != nil {
+		return
+	}
+	go watcher.Start()
+	defer watcher.Stop()
+	for range watcher.DoneCh() {
+		return
+	}
+}
+
+func (b *VaultBackend) Watch(prefix string, stop <-chan struct{}) (<-chan Event, error) {
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		last := map[string]string{}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				values, err := b.Get(prefix, "")
+				if err != nil {
+					log.Error("vault watch on " + prefix + ": " + err.Error())
+					continue
+				}
+				for k, v := range values {
+					if last[k] != v {
+						events <- Event{Key: k, Value: v}
+					}
+				}
+				last = values
+			}
+		}
+	}()
+	return events, nil
+}
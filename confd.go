@@ -4,16 +4,18 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/kelseyhightower/confd/log"
 	"github.com/kelseyhightower/go-ini"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -22,11 +24,19 @@ import (
 	"time"
 )
 
+var watch = flag.Bool("watch", false, "watch the backend for changes and render immediately, in addition to the interval loop")
+
 type Settings struct {
 	ConfigDir   string
+	Backend     string
 	EtcdURL     string
 	EtcdPrefix  string
+	ConsulURL   string
+	RedisURL    string
+	VaultURL    string
+	VaultToken  string
 	Interval    string
+	CmdTimeout  string
 	TemplateDir string
 }
 
@@ -41,14 +51,16 @@ type Service struct {
 }
 
 type Template struct {
-	Dest    string
-	Gid     int
-	Keys    []string
-	Mode    string
-	Uid     int
-	Service string
-	Src     string
-	Vars    map[string]interface{}
+	Dest     string
+	Gid      int
+	Keys     []string
+	Mode     string
+	Uid      int
+	Service  string
+	Src      string
+	Backend  string
+	CheckCmd string `json:"check_cmd"`
+	Vars     map[string]interface{}
 }
 
 type FileInfo struct {
@@ -62,24 +74,39 @@ var settings Settings
 var defaultConfig = "/etc/confd/confd.ini"
 
 func main() {
+	flag.Parse()
 	if err := setConfig(); err != nil {
 		log.Fatal(err.Error())
 	}
+	backend, err := NewBackend(settings)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 	configs, err := filepath.Glob(filepath.Join(settings.ConfigDir, "*json"))
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	for {
-		for _, config := range configs {
-			if err := ProcessConfig(config); err != nil {
-				log.Error(err.Error())
-			}
+	for _, config := range configs {
+		if err := ProcessConfig(config, backend); err != nil {
+			log.Error(err.Error())
 		}
+	}
+	if *watch {
+		stop := make(chan struct{})
+		defer close(stop)
+		watchConfigs(configs, backend, stop)
+	}
+	for {
 		interval, err := strconv.ParseInt(settings.Interval, 0, 64)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
 		time.Sleep(time.Duration(interval) * time.Second)
+		for _, config := range configs {
+			if err := ProcessConfig(config, backend); err != nil {
+				log.Error(err.Error())
+			}
+		}
 	}
 }
 
@@ -95,61 +122,116 @@ func NewConfigFromFile(name string) (*Config, error) {
 	return c, nil
 }
 
-func ProcessConfig(config string) error {
+func ProcessConfig(config string, defaultBackend Backend) error {
 	c, err := NewConfigFromFile(config)
 	if err != nil {
 		return err
 	}
 	for _, t := range c.Templates {
-		if err := t.GetValuesFromEctd(); err != nil {
-			return err
-		}
-		src := filepath.Join(settings.TemplateDir, t.Src)
-		if isFileExist(src) {
-			temp, err := ioutil.TempFile("", "")
-			defer os.Remove(temp.Name())
+		backend := defaultBackend
+		if t.Backend != "" {
+			perTemplate := settings
+			perTemplate.Backend = t.Backend
+			backend, err = NewBackend(perTemplate)
 			if err != nil {
 				return err
 			}
+		}
+		if err := processTemplate(c, t, backend); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			tmpl := template.Must(template.New(t.Src).ParseFiles(src))
-			if err = tmpl.Execute(temp, t.Vars); err != nil {
-				return err
-			}
-			if err = t.SetFileAttrs(temp.Name()); err != nil {
-				return err
+// processTemplate renders a single Template against backend and, if the
+// result differs from t.Dest, checks and promotes it. c is only needed to
+// look up the reload command for t.Service.
+func processTemplate(c *Config, t Template, backend Backend) error {
+	if err := t.GetValues(backend); err != nil {
+		return err
+	}
+	t.Vars["Env"] = envMap()
+	src := filepath.Join(settings.TemplateDir, t.Src)
+	if !isFileExist(src) {
+		return errors.New("Missing template: " + src)
+	}
+	temp, err := ioutil.TempFile("", "")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	usedSecret := false
+	tmpl := template.Must(template.New(t.Src).Funcs(funcMap(backend, settings.EtcdPrefix, &usedSecret)).ParseFiles(src))
+	if err = tmpl.Execute(temp, t.Vars); err != nil {
+		return err
+	}
+	if usedSecret {
+		mode, err := strconv.ParseUint(t.Mode, 0, 32)
+		if err != nil || mode&0077 != 0 {
+			t.Mode = "0600"
+		}
+	}
+	if err = t.SetFileAttrs(temp.Name()); err != nil {
+		return err
+	}
+	if !isSync(temp.Name(), t.Dest) {
+		log.Info(t.Dest + " not in sync")
+		if t.CheckCmd != "" {
+			checkCmd := strings.Replace(t.CheckCmd, "{{ .src }}", temp.Name(), -1)
+			if err := runCmd(checkCmd); err != nil {
+				return errors.New(t.Dest + " failed check_cmd: " + err.Error())
 			}
-			if !isSync(temp.Name(), t.Dest) {
-				log.Info(t.Dest + " not in sync")
-				os.Rename(temp.Name(), t.Dest)
-				cmd := c.Services[t.Service].ReloadCmd
-				log.Info("Running " + cmd)
+		}
+		if err := os.Rename(temp.Name(), t.Dest); err != nil {
+			return err
+		}
+		reloadCmd := c.Services[t.Service].ReloadCmd
+		if reloadCmd != "" {
+			if err := runCmd(reloadCmd); err != nil {
+				return errors.New(t.Dest + " failed reload_cmd: " + err.Error())
 			}
-		} else {
-			return errors.New("Missing template: " + src)
 		}
 	}
 	return nil
 }
 
-func (t *Template) GetValuesFromEctd() error {
-	c := etcd.NewClient()
+func (t *Template) GetValues(backend Backend) error {
 	r := strings.NewReplacer("/", "_")
 	t.Vars = make(map[string]interface{})
 	for _, key := range t.Keys {
-		values, err := c.Get(filepath.Join(settings.EtcdPrefix, key))
+		values, err := backend.Get(settings.EtcdPrefix, key)
 		if err != nil {
 			return err
 		}
-		for _, v := range values {
-			key := strings.TrimPrefix(v.Key, settings.EtcdPrefix)
-			new_key := r.Replace(key)
-			t.Vars[new_key] = v.Value
+		for k, v := range values {
+			newKey := r.Replace(strings.TrimPrefix(k, settings.EtcdPrefix))
+			t.Vars[newKey] = v
 		}
 	}
 	return nil
 }
 
+// runCmd runs cmdStr through the shell, capturing its output into the
+// logger, and kills it if it outlives settings.CmdTimeout.
+func runCmd(cmdStr string) error {
+	timeout, err := strconv.ParseInt(settings.CmdTimeout, 0, 64)
+	if err != nil {
+		timeout = 60
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	log.Info("Running " + cmdStr)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", cmdStr)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Info(string(out))
+	}
+	return err
+}
+
 func (t *Template) SetFileAttrs(name string) error {
 	mode, _ := strconv.ParseUint(t.Mode, 0, 32)
 	os.Chmod(name, os.FileMode(mode))
@@ -207,9 +289,11 @@ func isSync(src, dest string) bool {
 
 func setConfig() error {
 	settings.ConfigDir = "/etc/confd/conf.d"
+	settings.Backend = "etcd"
 	settings.EtcdURL = "http://0.0.0.0:4001"
 	settings.EtcdPrefix = "/"
 	settings.Interval = "600"
+	settings.CmdTimeout = "60"
 
 	if isFileExist(defaultConfig) {
 		s, err := ini.LoadFile(defaultConfig)
@@ -219,15 +303,33 @@ func setConfig() error {
 		if configDir, ok := s.Get("main", "config_dir"); ok {
 			settings.ConfigDir = configDir
 		}
+		if backend, ok := s.Get("main", "backend"); ok {
+			settings.Backend = backend
+		}
 		if etcdURL, ok := s.Get("etcd", "url"); ok {
 			settings.EtcdURL = etcdURL
 		}
 		if etcdPrefix, ok := s.Get("etcd", "prefix"); ok {
 			settings.EtcdPrefix = etcdPrefix
 		}
+		if consulURL, ok := s.Get("consul", "url"); ok {
+			settings.ConsulURL = consulURL
+		}
+		if redisURL, ok := s.Get("redis", "url"); ok {
+			settings.RedisURL = redisURL
+		}
+		if vaultURL, ok := s.Get("vault", "url"); ok {
+			settings.VaultURL = vaultURL
+		}
+		if vaultToken, ok := s.Get("vault", "token"); ok {
+			settings.VaultToken = vaultToken
+		}
 		if interval, ok := s.Get("main", "interval"); ok {
 			settings.Interval = interval
 		}
+		if cmdTimeout, ok := s.Get("main", "cmd_timeout"); ok {
+			settings.CmdTimeout = cmdTimeout
+		}
 
 	}
 	settings.TemplateDir = filepath.Join(settings.ConfigDir, "templates")
@@ -15,9 +15,13 @@
 package model
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/big"
+	stdnet "net"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -25,13 +29,25 @@ import (
 	"github.com/tigera/libcalico-go/lib/net"
 )
 
+// maxSplitSubBlocks caps how many sub-blocks Split will materialize in one
+// call, so a request like splitting a /64 into /128s (2^64 sub-blocks)
+// fails loudly instead of overflowing or allocating an enormous slice.
+const maxSplitSubBlocks = 1 << 20
+
 var (
-	matchBlock = regexp.MustCompile("^/?/calico/ipam/v2/assignment/ipv./block/([^/]+)$")
+	// The optional trailing /<prefixlen> identifies a single variable-length
+	// sub-block carved out of the block's own CIDR, e.g. a /64 handed out of
+	// a /56 for IPv6 prefix delegation.
+	matchBlock = regexp.MustCompile(`^/?/calico/ipam/v2/assignment/ipv./block/([^/]+?)(?:/(\d+))?$`)
 	typeBlock  = reflect.TypeOf(AllocationBlock{})
 )
 
 type BlockKey struct {
 	CIDR net.IPNet `json:"-" validate:"required,name"`
+
+	// SubBlockPrefixLen, when set, identifies a single SubBlock of CIDR
+	// rather than the block as a whole.
+	SubBlockPrefixLen *int `json:"-"`
 }
 
 func (key BlockKey) defaultPath() (string, error) {
@@ -40,6 +56,9 @@ func (key BlockKey) defaultPath() (string, error) {
 	}
 	c := strings.Replace(key.CIDR.String(), "/", "-", 1)
 	e := fmt.Sprintf("/calico/ipam/v2/assignment/ipv%d/block/%s", key.CIDR.Version(), c)
+	if key.SubBlockPrefixLen != nil {
+		e = fmt.Sprintf("%s/%d", e, *key.SubBlockPrefixLen)
+	}
 	return e, nil
 }
 
@@ -72,7 +91,16 @@ func (options BlockListOptions) KeyFromDefaultPath(path string) Key {
 	}
 	cidrStr := strings.Replace(r[0][1], "-", "/", 1)
 	_, cidr, _ := net.ParseCIDR(cidrStr)
-	return BlockKey{CIDR: *cidr}
+	key := BlockKey{CIDR: *cidr}
+	if r[0][2] != "" {
+		prefixLen, err := strconv.Atoi(r[0][2])
+		if err != nil {
+			log.Infof("%s had a non-numeric sub-block prefix length", path)
+			return nil
+		}
+		key.SubBlockPrefixLen = &prefixLen
+	}
+	return key
 }
 
 type AllocationBlock struct {
@@ -82,9 +110,162 @@ type AllocationBlock struct {
 	Allocations    []*int                `json:"allocations"`
 	Unallocated    []int                 `json:"unallocated"`
 	Attributes     []AllocationAttribute `json:"attributes"`
+
+	// SubBlocks holds variable-length allocations carved out of CIDR, e.g.
+	// /64s or /80s handed out of a /56 for IPv6 prefix delegation. A block
+	// written before SubBlocks existed has none until Migrate (run on every
+	// JSON decode) gives it a single sub-block covering the whole CIDR.
+	SubBlocks []SubBlock `json:"subBlocks,omitempty"`
 }
 
 type AllocationAttribute struct {
 	AttrPrimary   *string           `json:"handle_id"`
 	AttrSecondary map[string]string `json:"secondary"`
 }
+
+// SubBlock records a single variable-length allocation carved out of an
+// AllocationBlock's CIDR. Offset counts sub-blocks of PrefixLen from the
+// start of the parent CIDR, so the sub-block's own CIDR is recoverable from
+// the parent's CIDR plus these two fields.
+type SubBlock struct {
+	PrefixLen int               `json:"prefixLen"`
+	Offset    int               `json:"offset"`
+	HandleID  *string           `json:"handle_id"`
+	Attrs     map[string]string `json:"attrs"`
+}
+
+// ErrorInvalidSubBlockPrefix indicates a requested sub-block prefix length
+// is shorter than the block's own prefix length or longer than its address
+// width.
+type ErrorInvalidSubBlockPrefix struct {
+	PrefixLen int
+	BlockCIDR string
+}
+
+func (e ErrorInvalidSubBlockPrefix) Error() string {
+	return fmt.Sprintf("prefix length %d is not a valid sub-block of %s", e.PrefixLen, e.BlockCIDR)
+}
+
+// Split carves cidr into contiguous /prefixLen sub-blocks and returns them,
+// all unassigned, with Offsets counted from the start of cidr (so they match
+// SubBlock's Offset when cidr is b.CIDR). It neither reads nor mutates b;
+// callers add the result to b.SubBlocks once they've decided which
+// sub-blocks to hand out.
+func (b *AllocationBlock) Split(cidr net.IPNet, prefixLen int) ([]SubBlock, error) {
+	ones, bits := cidr.Mask.Size()
+	if prefixLen < ones || prefixLen > bits {
+		return nil, ErrorInvalidSubBlockPrefix{PrefixLen: prefixLen, BlockCIDR: cidr.String()}
+	}
+	delta := uint(prefixLen - ones)
+	// 1<<delta would silently wrap to 0 once delta reaches the word size
+	// (e.g. splitting a /64 into /128s), so check against maxSplitSubBlocks
+	// using a width that can't itself overflow.
+	if delta >= 63 || int64(1)<<delta > maxSplitSubBlocks {
+		return nil, fmt.Errorf("splitting %s into /%d sub-blocks would produce more than %d, which Split does not support", cidr.String(), prefixLen, maxSplitSubBlocks)
+	}
+	count := int(1 << delta)
+	subBlocks := make([]SubBlock, 0, count)
+	for i := 0; i < count; i++ {
+		subBlocks = append(subBlocks, SubBlock{PrefixLen: prefixLen, Offset: i})
+	}
+	return subBlocks, nil
+}
+
+// Merge reassembles the sub-blocks covering cidrs back into their parent
+// block. It fails if any of them is still in use or if one isn't found.
+func (b *AllocationBlock) Merge(cidrs []net.IPNet) error {
+	for _, cidr := range cidrs {
+		ones, _ := cidr.Mask.Size()
+		idx := -1
+		for i, sb := range b.SubBlocks {
+			sbCIDR, err := subBlockCIDR(b.CIDR, sb)
+			if err == nil && sb.PrefixLen == ones && sbCIDR.String() == cidr.String() {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			return fmt.Errorf("sub-block %s not found in block %s", cidr.String(), b.CIDR.String())
+		}
+		if b.SubBlocks[idx].HandleID != nil {
+			return fmt.Errorf("sub-block %s is still allocated to handle %s", cidr.String(), *b.SubBlocks[idx].HandleID)
+		}
+		b.SubBlocks = append(b.SubBlocks[:idx], b.SubBlocks[idx+1:]...)
+	}
+	return nil
+}
+
+// subBlockCIDR computes the CIDR of sb within parent.
+func subBlockCIDR(parent net.IPNet, sb SubBlock) (net.IPNet, error) {
+	ones, bits := parent.Mask.Size()
+	if sb.PrefixLen < ones || sb.PrefixLen > bits {
+		return net.IPNet{}, ErrorInvalidSubBlockPrefix{PrefixLen: sb.PrefixLen, BlockCIDR: parent.String()}
+	}
+	// A stale or corrupted SubBlock could carry an Offset that no longer
+	// fits within parent (e.g. after a CIDR resize), which would otherwise
+	// overflow the address width below. Reject it up front.
+	delta := uint(sb.PrefixLen - ones)
+	maxOffset := big.NewInt(1)
+	if delta < 63 {
+		maxOffset.Lsh(maxOffset, delta)
+	} else {
+		maxOffset.Lsh(maxOffset, 63)
+	}
+	if sb.Offset < 0 || big.NewInt(int64(sb.Offset)).Cmp(maxOffset) >= 0 {
+		return net.IPNet{}, fmt.Errorf("sub-block offset %d is out of range for /%d within %s", sb.Offset, sb.PrefixLen, parent.String())
+	}
+
+	base := new(big.Int).SetBytes(parent.IP.To16())
+	if len(parent.IP) == 4 || parent.IP.To4() != nil {
+		base = new(big.Int).SetBytes(parent.IP.To4())
+	}
+	step := new(big.Int).Lsh(big.NewInt(1), uint(bits-sb.PrefixLen))
+	offset := new(big.Int).Mul(step, big.NewInt(int64(sb.Offset)))
+	addr := new(big.Int).Add(base, offset)
+	if addr.Sign() < 0 {
+		return net.IPNet{}, fmt.Errorf("sub-block offset %d produces an address before %s", sb.Offset, parent.String())
+	}
+
+	out := addr.Bytes()
+	ipBytes := make([]byte, bits/8)
+	if len(out) > len(ipBytes) {
+		return net.IPNet{}, fmt.Errorf("sub-block offset %d is out of range for /%d within %s", sb.Offset, sb.PrefixLen, parent.String())
+	}
+	copy(ipBytes[len(ipBytes)-len(out):], out)
+
+	_, sbCIDR, err := net.ParseCIDR(fmt.Sprintf("%s/%d", stdnet.IP(ipBytes).String(), sb.PrefixLen))
+	if err != nil {
+		return net.IPNet{}, err
+	}
+	return *sbCIDR, nil
+}
+
+// Migrate converts a flat, pre-sub-block AllocationBlock into one backed by
+// SubBlocks, representing the whole block as a single, unassigned sub-block
+// at its own prefix length. The existing Allocations/Unallocated/Attributes
+// arrays are left untouched and continue to track individual address
+// assignments; Migrate only adds the SubBlocks view so callers that split
+// or merge sub-blocks have something to work from. It is a no-op once
+// SubBlocks is populated, so it is safe to call unconditionally after
+// reading a block from the datastore.
+func (b *AllocationBlock) Migrate() {
+	if len(b.SubBlocks) > 0 {
+		return
+	}
+	ones, _ := b.CIDR.Mask.Size()
+	b.SubBlocks = []SubBlock{{PrefixLen: ones, Offset: 0}}
+}
+
+// UnmarshalJSON decodes an AllocationBlock and runs Migrate on it, so that
+// every AllocationBlock read from the datastore (the only place blocks are
+// deserialized) gets a SubBlocks view even if it was written before
+// SubBlocks existed.
+func (b *AllocationBlock) UnmarshalJSON(data []byte) error {
+	type allocationBlock AllocationBlock
+	alias := (*allocationBlock)(b)
+	if err := json.Unmarshal(data, alias); err != nil {
+		return err
+	}
+	b.Migrate()
+	return nil
+}
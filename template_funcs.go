@@ -0,0 +1,226 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// funcMap builds the FuncMap made available to every template. backend and
+// prefix back getv/getvs so templates can pull in values beyond the ones
+// listed in Keys; usedSecret is set whenever the secret function is called,
+// so the caller can lock the rendered file down to mode 0600.
+func funcMap(backend Backend, prefix string, usedSecret *bool) template.FuncMap {
+	var vaultBackend Backend
+	return template.FuncMap{
+		"base64Encode": base64Encode,
+		"base64Decode": base64Decode,
+		"parseJSON":    parseJSON,
+		"toYAML":       toYAML,
+		"getv": func(key string, def ...string) string {
+			return getv(backend, prefix, key, def...)
+		},
+		"getvs": func(pattern string) []string {
+			return getvs(backend, prefix, pattern)
+		},
+		"lsdir":        lsdir,
+		"cidrContains": cidrContains,
+		"cidrHost":     cidrHost,
+		"secret": func(ref string) (string, error) {
+			if vaultBackend == nil {
+				var err error
+				vaultBackend, err = NewVaultBackend(settings)
+				if err != nil {
+					return "", err
+				}
+			}
+			v, err := secret(vaultBackend, ref)
+			if err != nil {
+				return "", err
+			}
+			*usedSecret = true
+			return v, nil
+		},
+	}
+}
+
+func base64Encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func base64Decode(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func parseJSON(s string) (interface{}, error) {
+	var v interface{}
+	err := json.Unmarshal([]byte(s), &v)
+	return v, err
+}
+
+func toYAML(v interface{}) (string, error) {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// getv returns the single value stored at prefix/key, or def[0] (or "" if
+// def is omitted) when the key isn't set. If key resolves to more than one
+// entry (i.e. it's a directory rather than a leaf), it deterministically
+// returns the one with the lexicographically smallest full key.
+func getv(backend Backend, prefix, key string, def ...string) string {
+	values, err := backend.Get(prefix, key)
+	if err == nil && len(values) > 0 {
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return values[keys[0]]
+	}
+	if len(def) > 0 {
+		return def[0]
+	}
+	return ""
+}
+
+// getvs returns every value under prefix/pattern, with the trailing "*"
+// stripped, sorted by key for deterministic rendering.
+func getvs(backend Backend, prefix, pattern string) []string {
+	key := strings.TrimSuffix(pattern, "*")
+	values, err := backend.Get(prefix, key)
+	if err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, values[k])
+	}
+	return out
+}
+
+func lsdir(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+func cidrContains(cidr, ip string) (bool, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false, errors.New("invalid IP: " + ip)
+	}
+	return ipnet.Contains(addr), nil
+}
+
+// cidrHost returns the IP at hostNum within cidr, counted from the network
+// address, e.g. cidrHost "10.0.0.0/24" 5 -> "10.0.0.5". hostNum must fall
+// within the range of addresses cidr covers.
+func cidrHost(cidr string, hostNum int) (string, error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	ones, bits := ipnet.Mask.Size()
+	// bits-ones commonly reaches 63+ for real IPv6 pool sizes (/64, /56,
+	// /48, /32, ...), where a raw int64 shift overflows or goes negative.
+	// Compare against a big.Int bound instead, as subBlockCIDR in
+	// lib/backend/model/block.go does.
+	maxHosts := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	if hostNum < 0 || big.NewInt(int64(hostNum)).Cmp(maxHosts) >= 0 {
+		return "", fmt.Errorf("host number %d is out of range for %s", hostNum, cidr)
+	}
+	base := new(big.Int).SetBytes(ip.Mask(ipnet.Mask))
+	addr := new(big.Int).Add(base, big.NewInt(int64(hostNum)))
+	out := addr.Bytes()
+	ipBytes := make([]byte, bits/8)
+	copy(ipBytes[len(ipBytes)-len(out):], out)
+	return net.IP(ipBytes).String(), nil
+}
+
+// envMap exposes the process environment to templates as {{ .Env.FOO }}.
+func envMap() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return env
+}
+
+// secret resolves a "vault:path#field" reference through backend (a Vault
+// backend) and returns the named field's value.
+func secret(backend Backend, ref string) (string, error) {
+	const scheme = "vault:"
+	if !strings.HasPrefix(ref, scheme) {
+		return "", errors.New("secret: unsupported reference: " + ref)
+	}
+	path := strings.TrimPrefix(ref, scheme)
+	path, field, ok := cutLast(path, "#")
+	if !ok {
+		return "", errors.New("secret: missing #field in: " + ref)
+	}
+	dir, key := filepathSplit(path)
+	values, err := backend.Get(dir, key)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range values {
+		if strings.HasSuffix(k, "/"+field) {
+			return v, nil
+		}
+	}
+	return "", errors.New("secret: field not found: " + ref)
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+func filepathSplit(path string) (dir, base string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
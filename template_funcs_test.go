@@ -0,0 +1,197 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeBackend is an in-memory Backend for exercising the template functions
+// without a real etcd/Consul/Redis/Vault connection. It joins prefix and
+// key the same way the real backends do, and matches the stored key equal
+// to that joined path plus every stored key under it as a directory.
+type fakeBackend struct {
+	values map[string]string
+}
+
+func (b *fakeBackend) Get(prefix, key string) (map[string]string, error) {
+	full := filepath.Join(prefix, key)
+	out := make(map[string]string)
+	for k, v := range b.values {
+		if k == full || strings.HasPrefix(k, full+"/") {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+func (b *fakeBackend) Watch(prefix string, stop <-chan struct{}) (<-chan Event, error) {
+	ch := make(chan Event)
+	close(ch)
+	return ch, nil
+}
+
+func TestGetv(t *testing.T) {
+	backend := &fakeBackend{values: map[string]string{
+		"/app/port": "8080",
+		"/app/host": "example.com",
+	}}
+
+	cases := []struct {
+		name string
+		key  string
+		def  []string
+		want string
+	}{
+		{"present", "/port", nil, "8080"},
+		{"missing with default", "/missing", []string{"fallback"}, "fallback"},
+		{"missing without default", "/missing", nil, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := getv(backend, "/app", c.key, c.def...)
+			if got != c.want {
+				t.Errorf("getv(%q) = %q, want %q", c.key, got, c.want)
+			}
+		})
+	}
+}
+
+func TestGetvDeterministicOnMultipleMatches(t *testing.T) {
+	backend := &fakeBackend{values: map[string]string{
+		"/app/nested/a": "first",
+		"/app/nested/b": "second",
+	}}
+	want := getv(backend, "/app", "/nested")
+	for i := 0; i < 10; i++ {
+		if got := getv(backend, "/app", "/nested"); got != want {
+			t.Fatalf("getv is nondeterministic: got %q, want %q", got, want)
+		}
+	}
+	if want != "first" {
+		t.Errorf("getv = %q, want lexicographically-first value %q", want, "first")
+	}
+}
+
+func TestGetvs(t *testing.T) {
+	backend := &fakeBackend{values: map[string]string{
+		"/app/nodes/b": "2",
+		"/app/nodes/a": "1",
+		"/app/nodes/c": "3",
+	}}
+	got := getvs(backend, "/app", "/nodes/*")
+	want := []string{"1", "2", "3"}
+	if len(got) != len(want) {
+		t.Fatalf("getvs returned %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("getvs()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestCidrHost(t *testing.T) {
+	cases := []struct {
+		name    string
+		cidr    string
+		hostNum int
+		want    string
+		wantErr bool
+	}{
+		{"first host", "10.0.0.0/24", 0, "10.0.0.0", false},
+		{"fifth host", "10.0.0.0/24", 5, "10.0.0.5", false},
+		{"negative host", "10.0.0.0/24", -1, "", true},
+		{"out of range", "10.0.0.0/24", 256, "", true},
+		{"ipv6", "2001:db8::/32", 1, "2001:db8::1", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := cidrHost(c.cidr, c.hostNum)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("cidrHost(%q, %d) = %q, want error", c.cidr, c.hostNum, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cidrHost(%q, %d) returned error: %v", c.cidr, c.hostNum, err)
+			}
+			if got != c.want {
+				t.Errorf("cidrHost(%q, %d) = %q, want %q", c.cidr, c.hostNum, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCidrContains(t *testing.T) {
+	ok, err := cidrContains("10.0.0.0/24", "10.0.0.5")
+	if err != nil || !ok {
+		t.Errorf("cidrContains(10.0.0.0/24, 10.0.0.5) = %v, %v, want true, nil", ok, err)
+	}
+	ok, err = cidrContains("10.0.0.0/24", "10.0.1.5")
+	if err != nil || ok {
+		t.Errorf("cidrContains(10.0.0.0/24, 10.0.1.5) = %v, %v, want false, nil", ok, err)
+	}
+	if _, err := cidrContains("10.0.0.0/24", "not-an-ip"); err == nil {
+		t.Error("cidrContains with an invalid IP should return an error")
+	}
+}
+
+func TestBase64RoundTrip(t *testing.T) {
+	encoded := base64Encode("hello world")
+	decoded, err := base64Decode(encoded)
+	if err != nil {
+		t.Fatalf("base64Decode returned error: %v", err)
+	}
+	if decoded != "hello world" {
+		t.Errorf("base64Decode(base64Encode(%q)) = %q", "hello world", decoded)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	v, err := parseJSON(`{"a": 1}`)
+	if err != nil {
+		t.Fatalf("parseJSON returned error: %v", err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok || m["a"] != 1.0 {
+		t.Errorf("parseJSON = %#v, want map[a:1]", v)
+	}
+}
+
+func TestToYAML(t *testing.T) {
+	out, err := toYAML(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatalf("toYAML returned error: %v", err)
+	}
+	if out != "a: 1\n" {
+		t.Errorf("toYAML = %q, want %q", out, "a: 1\n")
+	}
+}
+
+func TestSecret(t *testing.T) {
+	backend := &fakeBackend{values: map[string]string{
+		"db/creds/password": "s3cr3t",
+	}}
+	got, err := secret(backend, "vault:db/creds#password")
+	if err != nil {
+		t.Fatalf("secret returned error: %v", err)
+	}
+	if got != "s3cr3t" {
+		t.Errorf("secret(...) = %q, want %q", got, "s3cr3t")
+	}
+
+	if _, err := secret(backend, "db/creds#password"); err == nil {
+		t.Error("secret with a non-vault scheme should return an error")
+	}
+	if _, err := secret(backend, "vault:db/creds"); err == nil {
+		t.Error("secret with no #field should return an error")
+	}
+	if _, err := secret(backend, "vault:db/creds#missing"); err == nil {
+		t.Error("secret with an unknown field should return an error")
+	}
+}
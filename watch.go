@@ -0,0 +1,141 @@
+// Copyright (c) 2013 Kelsey Hightower. All rights reserved.
+// Use of this source code is governed by the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/kelseyhightower/confd/log"
+)
+
+// debounceWindow coalesces bursts of watch events (e.g. a whole IPAM block
+// being rewritten key by key) into a single re-render.
+const debounceWindow = 250 * time.Millisecond
+
+// minHealthyWatchDuration is how long a watch has to stay open before a
+// disconnect is treated as a one-off rather than a sign the backend is
+// unreachable. Watches that return an events channel and then immediately
+// close it (a common shape for transient disconnects) grow backoff just
+// like an outright Watch() error would.
+const minHealthyWatchDuration = 30 * time.Second
+
+// watchConfigs opens a watch on every template's Keys prefixes and
+// re-renders only the templates affected by each event. It runs alongside
+// the existing interval loop, which stays in place as a safety net against
+// missed or dropped watch events.
+func watchConfigs(configs []string, defaultBackend Backend, stop <-chan struct{}) {
+	for _, config := range configs {
+		c, err := NewConfigFromFile(config)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+		for _, t := range c.Templates {
+			backend := defaultBackend
+			if t.Backend != "" {
+				perTemplate := settings
+				perTemplate.Backend = t.Backend
+				backend, err = NewBackend(perTemplate)
+				if err != nil {
+					log.Error(err.Error())
+					continue
+				}
+			}
+			for _, key := range t.Keys {
+				go watchKey(c, t, backend, key, stop)
+			}
+		}
+	}
+}
+
+// watchKey keeps a single Template.Keys prefix watched for the life of the
+// process, reconnecting with exponential backoff and re-rendering the
+// template on every debounced burst of events.
+func watchKey(c *Config, t Template, backend Backend, key string, stop <-chan struct{}) {
+	backoff := time.Second
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		events, err := backend.Watch(filepath.Join(settings.EtcdPrefix, key), stop)
+		if err != nil {
+			log.Error("watch " + key + ": " + err.Error())
+			time.Sleep(backoff)
+			backoff = growBackoff(backoff)
+			continue
+		}
+
+		// A fresh watch, or a reconnect after a disconnect, always earns a
+		// full render so we never miss an update that happened while the
+		// watch was down.
+		render(c, t, backend)
+		opened := time.Now()
+		debounceRender(events, stop, c, t, backend)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		// debounceRender only returns once the events channel has closed,
+		// i.e. the watch disconnected. A watch that stayed open for a
+		// while is healthy, so reset backoff; one that closed almost
+		// immediately is repeatedly failing, so keep growing it and wait
+		// out the current backoff before reconnecting.
+		if time.Since(opened) >= minHealthyWatchDuration {
+			backoff = time.Second
+		} else {
+			time.Sleep(backoff)
+			backoff = growBackoff(backoff)
+		}
+	}
+}
+
+func growBackoff(backoff time.Duration) time.Duration {
+	if backoff < time.Minute {
+		return backoff * 2
+	}
+	return backoff
+}
+
+// debounceRender drains events until debounceWindow has passed with no new
+// ones, then renders once, repeating until the channel closes (disconnect)
+// or stop fires.
+func debounceRender(events <-chan Event, stop <-chan struct{}, c *Config, t Template, backend Backend) {
+	timer := time.NewTimer(debounceWindow)
+	defer timer.Stop()
+	pending := false
+	for {
+		select {
+		case <-stop:
+			return
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			pending = true
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(debounceWindow)
+		case <-timer.C:
+			if pending {
+				render(c, t, backend)
+				pending = false
+			}
+			timer.Reset(debounceWindow)
+		}
+	}
+}
+
+func render(c *Config, t Template, backend Backend) {
+	if err := processTemplate(c, t, backend); err != nil {
+		log.Error(err.Error())
+	}
+}